@@ -5,17 +5,26 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"debug/elf"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 
+	"golang.org/x/sync/errgroup"
+
+	"go.fuchsia.dev/fuchsia/tools/debug/covargs/diff"
+	"go.fuchsia.dev/fuchsia/tools/debug/covargs/export"
 	"go.fuchsia.dev/fuchsia/tools/debug/elflib"
 	"go.fuchsia.dev/fuchsia/tools/debug/symbolize/lib"
 	"go.fuchsia.dev/fuchsia/tools/lib/color"
@@ -34,8 +43,11 @@ var (
 	outputDir         string
 	llvmCov           string
 	llvmProfdata      string
-	outputFormat      string
+	outputs           outputsFlag
 	jsonOutput        string
+	jobs              int
+	baselineFile      string
+	minDelta          float64
 )
 
 func init() {
@@ -51,42 +63,57 @@ func init() {
 	flag.StringVar(&outputDir, "output-dir", "", "the directory to output results to")
 	flag.StringVar(&llvmProfdata, "llvm-profdata", "llvm-profdata", "the location of llvm-profdata")
 	flag.StringVar(&llvmCov, "llvm-cov", "llvm-cov", "the location of llvm-cov")
-	flag.StringVar(&outputFormat, "format", "html", "the output format used for llvm-cov")
-	flag.StringVar(&jsonOutput, "json-output", "", "outputs profile information to the specified file")
+	flag.Var(&outputs, "output", "a report to produce, as type=X,dest=Y,attr=value,...; may be repeated")
+	flag.StringVar(&jsonOutput, "json-output", "", "outputs profile information to the specified file; also writes a sibling <name>-summary.json with the run's coverage summary, usable as a later run's -baseline")
+	flag.IntVar(&jobs, "jobs", runtime.NumCPU(), "number of inputs to decode concurrently")
+	flag.StringVar(&baselineFile, "baseline", "", "path to the <name>-summary.json written alongside a previous run's -json-output, to diff the current coverage against")
+	flag.Float64Var(&minDelta, "min-delta", 0, "largest tolerable regression in overall line coverage percentage before -baseline comparison fails the run")
 }
 
-const llvmProfileSinkType = "llvm-profile"
+// outputsFlag accumulates one export.Output per repetition of -output.
+type outputsFlag []export.Output
 
-// Output is indexed by dump name
-func readSummary(summaryFiles []string) (map[string][]runtests.DataSink, error) {
-	sinks := make(map[string][]runtests.DataSink)
+func (o *outputsFlag) String() string {
+	return fmt.Sprint(*o)
+}
 
-	for _, summaryFile := range summaryFiles {
-		// TODO(phosek): process these in parallel using goroutines.
-		file, err := os.Open(summaryFile)
-		if err != nil {
-			return nil, fmt.Errorf("cannot open %q: %v", summaryFile, err)
-		}
-		defer file.Close()
+func (o *outputsFlag) Set(s string) error {
+	out, err := export.ParseOutput(s)
+	if err != nil {
+		return err
+	}
+	*o = append(*o, out)
+	return nil
+}
 
-		var summary runtests.TestSummary
-		if err := json.NewDecoder(file).Decode(&summary); err != nil {
-			return nil, fmt.Errorf("cannot decode %q: %v", summaryFile, err)
-		}
+const llvmProfileSinkType = "llvm-profile"
 
-		dir := filepath.Dir(summaryFile)
-		for _, detail := range summary.Tests {
-			for name, data := range detail.DataSinks {
-				for _, sink := range data {
-					sinks[name] = append(sinks[name], runtests.DataSink{
-						Name: sink.Name,
-						File: filepath.Join(dir, sink.File),
-					})
-				}
+// decodeSummaryFile reads a single summary.json, returning its data sinks
+// indexed by dump name.
+func decodeSummaryFile(summaryFile string) (map[string][]runtests.DataSink, error) {
+	file, err := os.Open(summaryFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %q: %v", summaryFile, err)
+	}
+	defer file.Close()
+
+	var summary runtests.TestSummary
+	if err := json.NewDecoder(file).Decode(&summary); err != nil {
+		return nil, fmt.Errorf("cannot decode %q: %v", summaryFile, err)
+	}
+
+	dir := filepath.Dir(summaryFile)
+	sinks := make(map[string][]runtests.DataSink)
+	for _, detail := range summary.Tests {
+		for name, data := range detail.DataSinks {
+			for _, sink := range data {
+				sinks[name] = append(sinks[name], runtests.DataSink{
+					Name: sink.Name,
+					File: filepath.Join(dir, sink.File),
+				})
 			}
 		}
 	}
-
 	return sinks, nil
 }
 
@@ -98,26 +125,23 @@ type SymbolizerDump struct {
 
 type SymbolizerOutput []SymbolizerDump
 
-func readSymbolizerOutput(outputFiles []string) (map[string]SymbolizerDump, error) {
-	dumps := make(map[string]SymbolizerDump)
-
-	for _, outputFile := range outputFiles {
-		// TODO(phosek): process these in parallel using goroutines.
-		file, err := os.Open(outputFile)
-		if err != nil {
-			return nil, fmt.Errorf("cannot open %q: %v", outputFile, err)
-		}
-		defer file.Close()
-		var output SymbolizerOutput
-		if err := json.NewDecoder(file).Decode(&output); err != nil {
-			return nil, fmt.Errorf("cannot decode %q: %v", outputFile, err)
-		}
-
-		for _, dump := range output {
-			dumps[dump.DumpName] = dump
-		}
+// decodeSymbolizerFile reads a single symbolizer dump, returning its entries
+// indexed by dump name.
+func decodeSymbolizerFile(outputFile string) (map[string]SymbolizerDump, error) {
+	file, err := os.Open(outputFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %q: %v", outputFile, err)
+	}
+	defer file.Close()
+	var output SymbolizerOutput
+	if err := json.NewDecoder(file).Decode(&output); err != nil {
+		return nil, fmt.Errorf("cannot decode %q: %v", outputFile, err)
 	}
 
+	dumps := make(map[string]SymbolizerDump)
+	for _, dump := range output {
+		dumps[dump.DumpName] = dump
+	}
 	return dumps, nil
 }
 
@@ -150,24 +174,102 @@ type ProfileEntry struct {
 	ModuleFiles []string `json:"modules"`
 }
 
-func readInfo(dumpFiles, summaryFiles []string, idsFile string) (*indexedInfo, error) {
-	summary, err := readSummary(summaryFile)
+// readInfo decodes all summary, symbolizer-dump, and ids.txt inputs. The
+// summary and symbolizer-dump files are decoded concurrently by a worker
+// pool bounded by -jobs, with a single writer goroutine merging results into
+// the returned indexedInfo; this keeps decoding off the critical path for
+// coverage runs with hundreds of shard summaries. A cancelled ctx (e.g. from
+// a SIGINT) aborts promptly instead of waiting for every file to decode.
+func readInfo(ctx context.Context, dumpFiles, summaryFiles []string, idsFile string) (*indexedInfo, error) {
+	ids, err := readIDsTxt(idsFile)
 	if err != nil {
 		return nil, err
 	}
-	dumps, err := readSymbolizerOutput(symbolizeDumpFile)
-	if err != nil {
-		return nil, err
+
+	poolSize := jobs
+	if poolSize < 1 {
+		poolSize = 1
 	}
-	ids, err := readIDsTxt(idsFile)
-	if err != nil {
-		return nil, err
+	summaryCh := make(chan map[string][]runtests.DataSink)
+	dumpCh := make(chan map[string]SymbolizerDump)
+	sem := make(chan struct{}, poolSize)
+
+	g, gctx := errgroup.WithContext(ctx)
+	for _, summaryFile := range summaryFiles {
+		summaryFile := summaryFile
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+			sinks, err := decodeSummaryFile(summaryFile)
+			if err != nil {
+				return err
+			}
+			select {
+			case summaryCh <- sinks:
+				return nil
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+		})
 	}
-	return &indexedInfo{
-		dumps:   dumps,
-		summary: summary,
+	for _, dumpFile := range dumpFiles {
+		dumpFile := dumpFile
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+			dumps, err := decodeSymbolizerFile(dumpFile)
+			if err != nil {
+				return err
+			}
+			select {
+			case dumpCh <- dumps:
+				return nil
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+		})
+	}
+
+	info := &indexedInfo{
+		dumps:   make(map[string]SymbolizerDump),
+		summary: make(map[string][]runtests.DataSink),
 		ids:     ids,
-	}, nil
+	}
+	merged := make(chan struct{})
+	go func() {
+		defer close(merged)
+		remaining := len(summaryFiles) + len(dumpFiles)
+		for remaining > 0 {
+			select {
+			case sinks := <-summaryCh:
+				for name, data := range sinks {
+					info.summary[name] = append(info.summary[name], data...)
+				}
+				remaining--
+			case dumps := <-dumpCh:
+				for name, dump := range dumps {
+					info.dumps[name] = dump
+				}
+				remaining--
+			case <-gctx.Done():
+				return
+			}
+		}
+	}()
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	<-merged
+	return info, nil
 }
 
 func mergeInfo(ctx context.Context, info *indexedInfo) ([]ProfileEntry, error) {
@@ -206,12 +308,60 @@ type Action struct {
 	Args []string `json:"args"`
 }
 
+// Run executes the action, streaming its combined stdout/stderr to the
+// logger at debug level as it runs rather than buffering it, and killing the
+// child promptly if ctx is cancelled. It still returns the combined output
+// so callers can include it in error messages.
 func (a Action) Run(ctx context.Context) ([]byte, error) {
 	logger.Debugf(ctx, "%s\n", a.String())
-	if !dryRun {
-		return exec.Command(a.Path, a.Args...).CombinedOutput()
+	if dryRun {
+		return nil, nil
+	}
+
+	cmd := exec.CommandContext(ctx, a.Path, a.Args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	var streamErr error
+	var wg sync.WaitGroup
+	stream := func(r io.Reader) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 4096), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			logger.Debugf(ctx, "%s\n", line)
+			mu.Lock()
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+			mu.Unlock()
+		}
+		if err := scanner.Err(); err != nil {
+			mu.Lock()
+			streamErr = err
+			mu.Unlock()
+		}
 	}
-	return nil, nil
+	wg.Add(2)
+	go stream(stdout)
+	go stream(stderr)
+	wg.Wait()
+
+	if waitErr := cmd.Wait(); waitErr != nil {
+		return buf.Bytes(), waitErr
+	}
+	return buf.Bytes(), streamErr
 }
 
 func (a Action) String() string {
@@ -223,6 +373,82 @@ func (a Action) String() string {
 	return buf.String()
 }
 
+// baselineSummaryPath returns the path -json-output's paired diff.Baseline
+// is written to: e.g. "profile.json" -> "profile-summary.json".
+func baselineSummaryPath(jsonOutput string) string {
+	ext := filepath.Ext(jsonOutput)
+	return strings.TrimSuffix(jsonOutput, ext) + "-summary" + ext
+}
+
+// summaryFilenames returns the source filenames of a coverage summary, for
+// passing to commonRoot.
+func summaryFilenames(summary []diff.FileSummary) []string {
+	names := make([]string, len(summary))
+	for i, f := range summary {
+		names[i] = f.Filename
+	}
+	return names
+}
+
+// commonRoot returns the deepest directory common to every path in paths,
+// or "" if paths is empty.
+func commonRoot(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	root := filepath.Dir(paths[0])
+	for _, p := range paths[1:] {
+		root = commonDir(root, filepath.Dir(p))
+	}
+	return root
+}
+
+func commonDir(a, b string) string {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	for a != b && a != "." && a != string(filepath.Separator) {
+		if len(a) > len(b) {
+			a = filepath.Dir(a)
+		} else {
+			b = filepath.Dir(b)
+		}
+	}
+	if a != b {
+		return string(filepath.Separator)
+	}
+	return a
+}
+
+// diffAgainstBaseline compares current (normalized against currentRoot) to
+// the summary stored at -baseline, writes the result to coverage-diff.json
+// in outputDir, and returns an error if the regression exceeds -min-delta.
+func diffAgainstBaseline(current []diff.FileSummary, currentRoot string) error {
+	file, err := os.Open(baselineFile)
+	if err != nil {
+		return fmt.Errorf("opening -baseline %q: %v", baselineFile, err)
+	}
+	defer file.Close()
+	baseline, err := diff.ReadBaseline(file)
+	if err != nil {
+		return fmt.Errorf("reading -baseline %q: %v", baselineFile, err)
+	}
+
+	report := diff.Compute(baseline.Summary, baseline.Root, current, currentRoot, minDelta)
+
+	diffFile, err := os.Create(filepath.Join(outputDir, "coverage-diff.json"))
+	if err != nil {
+		return fmt.Errorf("creating coverage-diff.json: %v", err)
+	}
+	defer diffFile.Close()
+	if err := json.NewEncoder(diffFile).Encode(report); err != nil {
+		return fmt.Errorf("writing coverage-diff.json: %v", err)
+	}
+
+	if report.Regressed {
+		return fmt.Errorf("coverage regressed by %.2f%%, exceeding -min-delta %.2f%%", -report.LineCoverageDelta, minDelta)
+	}
+	return nil
+}
+
 func isInstrumented(filepath string) bool {
 	sections := []string{"__llvm_covmap", "__llvm_prf_names"}
 	file, err := os.Open(filepath)
@@ -250,7 +476,7 @@ func process(ctx context.Context) error {
 	}
 
 	// Read in all the data
-	info, err := readInfo(symbolizeDumpFile, summaryFile, idsFile)
+	info, err := readInfo(ctx, symbolizeDumpFile, summaryFile, idsFile)
 	if err != nil {
 		return fmt.Errorf("parsing info: %v", err)
 	}
@@ -261,17 +487,6 @@ func process(ctx context.Context) error {
 		return fmt.Errorf("merging info: %v", err)
 	}
 
-	if jsonOutput != "" {
-		file, err := os.Create(jsonOutput)
-		if err != nil {
-			return fmt.Errorf("creating profile output file: %v", err)
-		}
-		defer file.Close()
-		if err := json.NewEncoder(file).Encode(entries); err != nil {
-			return fmt.Errorf("writing profile information: %v", err)
-		}
-	}
-
 	// Gather the set of modules and coverage files
 	modSet := make(map[string]struct{})
 	var mods []string
@@ -285,7 +500,7 @@ func process(ctx context.Context) error {
 		}
 		// TODO(https://bugs.fuchsia.dev/p/fuchsia/issues/detail?id=34796): ideally this would
 		// be handled by llvm-profdata tool itself.
-		cmd := exec.Command(llvmProfdata, "show", entry.ProfileData)
+		cmd := exec.CommandContext(ctx, llvmProfdata, "show", entry.ProfileData)
 		if err := cmd.Run(); err != nil {
 			if _, ok := err.(*exec.ExitError); ok {
 				logger.Warningf(ctx, "profile %q is corrupted\n", entry.ProfileData)
@@ -325,27 +540,116 @@ func process(ctx context.Context) error {
 		return fmt.Errorf("%v:\n%s", err, string(data))
 	}
 
-	// Make the llvm-cov response file
-	covFile, err := os.Create(filepath.Join(dir, "llvm-cov.rsp"))
-	if err != nil {
-		return fmt.Errorf("creating llvm-cov.rsp file: %v", err)
+	// If this run will be diffed against a baseline, or might become one for
+	// a later run, capture its coverage summary and the root its source
+	// files share so filenames can be normalized across output directories
+	// when diffing. The root is derived from the summary's own source
+	// filenames (e.g. src/...), not from the instrumented module binary
+	// paths (e.g. out/obj/.../ids.txt Filepath): the two live under
+	// unrelated directory trees, so a module root is never a prefix of a
+	// source path.
+	var currentSummary []diff.FileSummary
+	var currentRoot string
+	if baselineFile != "" || jsonOutput != "" {
+		// The -object list scales with the number of instrumented modules,
+		// which on a large build can run into the hundreds; pass it via a
+		// response file rather than directly on argv, the same way
+		// llvm-profdata.rsp keeps the merge command above under the
+		// platform's argument-list limit.
+		objectsRspFile, err := os.Create(filepath.Join(dir, "llvm-cov-objects.rsp"))
+		if err != nil {
+			return fmt.Errorf("creating llvm-cov-objects.rsp file: %v", err)
+		}
+		for _, mod := range mods {
+			fmt.Fprintf(objectsRspFile, "-object\n%s\n", mod)
+		}
+		objectsRspFile.Close()
+
+		// Intentionally not -summary-only: Compute needs each file's
+		// segments to report which lines newly lost coverage, and only a
+		// full export carries them.
+		exportArgs := []string{"export", "-instr-profile", mergedFile, "@" + objectsRspFile.Name()}
+		// llvm-cov export emits its JSON as a single, potentially huge line,
+		// so this is captured with exec directly rather than through
+		// Action.Run: its line-oriented scanner caps an individual line at
+		// 1MB, which a summary for a large, many-shard build can exceed.
+		logger.Debugf(ctx, "%s %s\n", llvmCov, exportArgs)
+		var summaryData []byte
+		if !dryRun {
+			cmd := exec.CommandContext(ctx, llvmCov, exportArgs...)
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			summaryData, err = cmd.Output()
+			if err != nil {
+				return fmt.Errorf("llvm-cov export: %v:\n%s", err, stderr.String())
+			}
+			if currentSummary, err = diff.ReadSummary(bytes.NewReader(summaryData)); err != nil {
+				return fmt.Errorf("reading current coverage summary: %v", err)
+			}
+			currentRoot = commonRoot(summaryFilenames(currentSummary))
+		}
+	}
+
+	if jsonOutput != "" {
+		file, err := os.Create(jsonOutput)
+		if err != nil {
+			return fmt.Errorf("creating profile output file: %v", err)
+		}
+		defer file.Close()
+		if err := json.NewEncoder(file).Encode(entries); err != nil {
+			return fmt.Errorf("writing profile information: %v", err)
+		}
+
+		// Persisted alongside -json-output rather than folded into it, so
+		// existing consumers that parse -json-output as a plain
+		// []ProfileEntry array keep working.
+		summaryPath := baselineSummaryPath(jsonOutput)
+		summaryOut, err := os.Create(summaryPath)
+		if err != nil {
+			return fmt.Errorf("creating %s: %v", summaryPath, err)
+		}
+		defer summaryOut.Close()
+		baseline := diff.Baseline{Root: currentRoot, Summary: currentSummary}
+		if err := json.NewEncoder(summaryOut).Encode(baseline); err != nil {
+			return fmt.Errorf("writing %s: %v", summaryPath, err)
+		}
 	}
-	for _, mod := range mods {
-		fmt.Fprintf(covFile, "-object %s\n", mod)
+
+	// Produce all the requested reports in parallel. Each exporter invokes
+	// llvm-cov independently against the same merged profile, so a single
+	// run of covargs can hand CI an LCOV file and a human an HTML tree
+	// without re-running llvm-profdata merge for each one.
+	requested := outputs
+	if len(requested) == 0 {
+		requested = outputsFlag{{Type: "html", Attrs: map[string]string{"dest": outputDir}}}
 	}
-	covFile.Close()
 
-	// Produce output
-	showCmd := Action{Path: llvmCov, Args: []string{
-		"show",
-		"-format", outputFormat,
-		"-instr-profile", mergedFile,
-		"-output-dir", outputDir,
-		"@" + covFile.Name(),
-	}}
-	data, err = showCmd.Run(ctx)
-	if err != nil {
-		return fmt.Errorf("%v:\n%s", err, string(data))
+	env := export.Env{
+		LlvmCov:       llvmCov,
+		MergedProfile: mergedFile,
+		Modules:       mods,
+		DryRun:        dryRun,
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	for _, out := range requested {
+		exporter, err := export.New(out)
+		if err != nil {
+			return fmt.Errorf("-output %+v: %v", out, err)
+		}
+		g.Go(func() error {
+			return exporter.Export(gctx, env)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	// Checked last, after every requested report has been written: a
+	// regressing CI run still needs its HTML/LCOV artifacts to debug the
+	// regression, not just coverage-diff.json.
+	if baselineFile != "" {
+		return diffAgainstBaseline(currentSummary, currentRoot)
 	}
 	return nil
 }
@@ -0,0 +1,253 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package diff compares the coverage summary produced by the current
+// covargs run against a baseline captured by a previous run, so CI can gate
+// a change on coverage regressions with the same tool that produces the
+// human-facing report.
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Counts is the `summary.lines`/`summary.functions` object from the JSON
+// emitted by `llvm-cov export`.
+type Counts struct {
+	Count   int     `json:"count"`
+	Covered int     `json:"covered"`
+	Percent float64 `json:"percent"`
+}
+
+// Segment is one entry of a file's `segments` array: [line, col, count,
+// hasCount, isRegionEntry, isGapRegion]. It marks that, from this line
+// onward, the enclosing region was executed count times, until the next
+// segment in the file.
+type Segment struct {
+	Line          int
+	Col           int
+	Count         int
+	HasCount      bool
+	IsRegionEntry bool
+	IsGapRegion   bool
+}
+
+func (s *Segment) UnmarshalJSON(b []byte) error {
+	var raw [6]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	s.Line = int(raw[0].(float64))
+	s.Col = int(raw[1].(float64))
+	s.Count = int(raw[2].(float64))
+	s.HasCount, _ = raw[3].(bool)
+	s.IsRegionEntry, _ = raw[4].(bool)
+	s.IsGapRegion, _ = raw[5].(bool)
+	return nil
+}
+
+// FileSummary is a single entry of `data[0].files` from `llvm-cov export`.
+// Segments is only populated when the export was run without
+// -summary-only.
+type FileSummary struct {
+	Filename string    `json:"filename"`
+	Segments []Segment `json:"segments"`
+	Summary  struct {
+		Lines     Counts `json:"lines"`
+		Functions Counts `json:"functions"`
+	} `json:"summary"`
+}
+
+type llvmCovExport struct {
+	Data []struct {
+		Files []FileSummary `json:"files"`
+	} `json:"data"`
+}
+
+// ReadSummary parses the JSON produced by `llvm-cov export`. A plain
+// `llvm-cov export -summary-only` document decodes fine too, but its files
+// carry no Segments, so Compute can't report newly-uncovered lines for it.
+func ReadSummary(r io.Reader) ([]FileSummary, error) {
+	var export llvmCovExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, fmt.Errorf("decoding llvm-cov export summary: %v", err)
+	}
+	if len(export.Data) == 0 {
+		return nil, nil
+	}
+	return export.Data[0].Files, nil
+}
+
+// Baseline is the artifact a covargs run persists alongside -json-output,
+// in a sibling "<name>-summary.json" file, so a later run can diff against
+// it with -baseline.
+type Baseline struct {
+	// Root is the common ancestor directory of Summary's own source
+	// filenames, used to normalize filenames when diffing against a run
+	// whose builds live under a different output directory.
+	Root    string        `json:"root"`
+	Summary []FileSummary `json:"summary"`
+}
+
+// ReadBaseline parses a Baseline previously written alongside -json-output.
+func ReadBaseline(r io.Reader) (*Baseline, error) {
+	var baseline Baseline
+	if err := json.NewDecoder(r).Decode(&baseline); err != nil {
+		return nil, fmt.Errorf("decoding baseline: %v", err)
+	}
+	return &baseline, nil
+}
+
+// Normalize strips root from filename if filename is root itself (leaving
+// "") or is rooted under it, so
+// that two builds which instrumented the same sources from different output
+// directories compare equal. root is typically the common ancestor
+// directory of a run's own coverage summary filenames.
+func Normalize(filename, root string) string {
+	if root == "" {
+		return filename
+	}
+	trimmed := strings.TrimSuffix(root, "/")
+	if filename == trimmed {
+		return ""
+	}
+	prefix := trimmed + "/"
+	if rel := strings.TrimPrefix(filename, prefix); rel != filename {
+		return rel
+	}
+	return filename
+}
+
+// FileDiff is the per-file entry of a Report.
+type FileDiff struct {
+	Filename          string  `json:"filename"`
+	Status            string  `json:"status"` // "added", "removed", or "changed"
+	LineCoverageDelta float64 `json:"line_coverage_delta"`
+	FuncCoverageDelta float64 `json:"func_coverage_delta"`
+	// NewlyUncoveredLines are 1-based source lines that were covered in the
+	// baseline and are not covered in the current run. Empty when either
+	// side's FileSummary has no Segments (e.g. it came from a
+	// -summary-only export).
+	NewlyUncoveredLines []int `json:"newly_uncovered_lines,omitempty"`
+}
+
+// Report is the contents of coverage-diff.json.
+type Report struct {
+	Files []FileDiff `json:"files"`
+	// LineCoverageDelta is the overall line-coverage percentage of every
+	// file in the current run minus that of every file in the baseline;
+	// added and removed files count toward their own run's total.
+	LineCoverageDelta float64 `json:"line_coverage_delta"`
+	// Regressed is true when LineCoverageDelta is a regression larger
+	// than the -min-delta threshold the caller supplied to Compute.
+	Regressed bool `json:"regressed"`
+}
+
+// Compute diffs current against baseline, normalizing both sets of
+// filenames against their respective build roots first. minDelta is the
+// largest tolerable regression in overall line coverage (e.g. 0.5 for half
+// a percentage point) before Report.Regressed is set.
+func Compute(baseline []FileSummary, baselineRoot string, current []FileSummary, currentRoot string, minDelta float64) Report {
+	baselineByFile := make(map[string]FileSummary, len(baseline))
+	for _, f := range baseline {
+		baselineByFile[Normalize(f.Filename, baselineRoot)] = f
+	}
+	currentByFile := make(map[string]FileSummary, len(current))
+	for _, f := range current {
+		currentByFile[Normalize(f.Filename, currentRoot)] = f
+	}
+
+	var report Report
+	var baseCovered, baseTotal, curCovered, curTotal int
+
+	for name, base := range baselineByFile {
+		baseCovered += base.Summary.Lines.Covered
+		baseTotal += base.Summary.Lines.Count
+		cur, ok := currentByFile[name]
+		if !ok {
+			report.Files = append(report.Files, FileDiff{Filename: name, Status: "removed"})
+			continue
+		}
+		lineDelta := cur.Summary.Lines.Percent - base.Summary.Lines.Percent
+		funcDelta := cur.Summary.Functions.Percent - base.Summary.Functions.Percent
+		// Computed regardless of the percentage deltas below: a file can
+		// lose coverage on some lines and gain it on others for a net-zero
+		// percentage change, and those newly-uncovered lines still belong
+		// in the report.
+		uncovered := newlyUncoveredLines(base.Segments, cur.Segments)
+		if lineDelta != 0 || funcDelta != 0 || len(uncovered) > 0 {
+			report.Files = append(report.Files, FileDiff{
+				Filename:            name,
+				Status:              "changed",
+				LineCoverageDelta:   lineDelta,
+				FuncCoverageDelta:   funcDelta,
+				NewlyUncoveredLines: uncovered,
+			})
+		}
+	}
+	for name, cur := range currentByFile {
+		curCovered += cur.Summary.Lines.Covered
+		curTotal += cur.Summary.Lines.Count
+		if _, ok := baselineByFile[name]; !ok {
+			report.Files = append(report.Files, FileDiff{Filename: name, Status: "added"})
+		}
+	}
+
+	basePercent, curPercent := percent(baseCovered, baseTotal), percent(curCovered, curTotal)
+	report.LineCoverageDelta = curPercent - basePercent
+	report.Regressed = report.LineCoverageDelta < -minDelta
+	return report
+}
+
+func percent(covered, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(covered) / float64(total)
+}
+
+// newlyUncoveredLines returns the sorted, 1-based lines that are covered in
+// base and not covered in cur. Returns nil if either side lacks segments.
+func newlyUncoveredLines(base, cur []Segment) []int {
+	if len(base) == 0 || len(cur) == 0 {
+		return nil
+	}
+	baseCovered := coveredLines(base)
+	curCovered := coveredLines(cur)
+
+	var lines []int
+	for line := range baseCovered {
+		if !curCovered[line] {
+			lines = append(lines, line)
+		}
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// coveredLines expands a file's segments into the set of lines with a
+// nonzero execution count. Each segment's count applies from its own line
+// up to (but not including) the next segment's line; a segment's count
+// can't be extended past the last segment in the slice, since nothing marks
+// where that last region ends.
+func coveredLines(segments []Segment) map[int]bool {
+	covered := make(map[int]bool)
+	for i, seg := range segments {
+		if !seg.HasCount || seg.Count == 0 {
+			continue
+		}
+		end := seg.Line
+		if i+1 < len(segments) && segments[i+1].Line > seg.Line {
+			end = segments[i+1].Line - 1
+		}
+		for line := seg.Line; line <= end; line++ {
+			covered[line] = true
+		}
+	}
+	return covered
+}
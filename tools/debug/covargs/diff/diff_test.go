@@ -0,0 +1,251 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package diff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		root     string
+		want     string
+	}{
+		{
+			name:     "empty root returns filename unchanged",
+			filename: "/src/out/foo.cc",
+			root:     "",
+			want:     "/src/out/foo.cc",
+		},
+		{
+			name:     "filename rooted under root is stripped",
+			filename: "/src/out/foo/bar.cc",
+			root:     "/src/out",
+			want:     "foo/bar.cc",
+		},
+		{
+			name:     "root with trailing slash behaves the same",
+			filename: "/src/out/foo/bar.cc",
+			root:     "/src/out/",
+			want:     "foo/bar.cc",
+		},
+		{
+			name:     "filename equal to root is stripped to empty string",
+			filename: "/src/out",
+			root:     "/src/out",
+			want:     "",
+		},
+		{
+			name:     "sibling directory sharing a string prefix is not stripped",
+			filename: "/src/out-other/foo.cc",
+			root:     "/src/out",
+			want:     "/src/out-other/foo.cc",
+		},
+		{
+			name:     "filename outside root is returned unchanged",
+			filename: "/other/foo.cc",
+			root:     "/src/out",
+			want:     "/other/foo.cc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Normalize(tt.filename, tt.root); got != tt.want {
+				t.Errorf("Normalize(%q, %q) = %q, want %q", tt.filename, tt.root, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompute(t *testing.T) {
+	t.Run("added and removed files", func(t *testing.T) {
+		baseline := []FileSummary{
+			{Filename: "/src/removed.cc", Summary: struct {
+				Lines     Counts `json:"lines"`
+				Functions Counts `json:"functions"`
+			}{Lines: Counts{Count: 10, Covered: 10, Percent: 100}}},
+		}
+		current := []FileSummary{
+			{Filename: "/src/added.cc", Summary: struct {
+				Lines     Counts `json:"lines"`
+				Functions Counts `json:"functions"`
+			}{Lines: Counts{Count: 10, Covered: 5, Percent: 50}}},
+		}
+		report := Compute(baseline, "/src", current, "/src", 0)
+
+		want := []FileDiff{
+			{Filename: "removed.cc", Status: "removed"},
+			{Filename: "added.cc", Status: "added"},
+		}
+		if !sameFileDiffSet(report.Files, want) {
+			t.Errorf("Compute(...).Files = %+v, want (in any order) %+v", report.Files, want)
+		}
+	})
+
+	t.Run("unchanged file produces no entry", func(t *testing.T) {
+		summary := []FileSummary{
+			{Filename: "/src/foo.cc", Summary: struct {
+				Lines     Counts `json:"lines"`
+				Functions Counts `json:"functions"`
+			}{Lines: Counts{Count: 10, Covered: 10, Percent: 100}}},
+		}
+		report := Compute(summary, "/src", summary, "/src", 0)
+		if len(report.Files) != 0 {
+			t.Errorf("Compute(...).Files = %+v, want none", report.Files)
+		}
+		if report.LineCoverageDelta != 0 {
+			t.Errorf("Compute(...).LineCoverageDelta = %v, want 0", report.LineCoverageDelta)
+		}
+		if report.Regressed {
+			t.Errorf("Compute(...).Regressed = true, want false")
+		}
+	})
+
+	t.Run("changed file reports deltas and newly uncovered lines", func(t *testing.T) {
+		baseline := []FileSummary{
+			{
+				Filename: "/src/foo.cc",
+				Segments: []Segment{
+					{Line: 1, Count: 1, HasCount: true},
+					{Line: 2, Count: 1, HasCount: true},
+					{Line: 3, Count: 0, HasCount: true},
+				},
+				Summary: struct {
+					Lines     Counts `json:"lines"`
+					Functions Counts `json:"functions"`
+				}{
+					Lines:     Counts{Count: 3, Covered: 2, Percent: 66.6},
+					Functions: Counts{Count: 1, Covered: 1, Percent: 100},
+				},
+			},
+		}
+		current := []FileSummary{
+			{
+				Filename: "/src/foo.cc",
+				Segments: []Segment{
+					{Line: 1, Count: 1, HasCount: true},
+					{Line: 2, Count: 0, HasCount: true},
+					{Line: 3, Count: 0, HasCount: true},
+				},
+				Summary: struct {
+					Lines     Counts `json:"lines"`
+					Functions Counts `json:"functions"`
+				}{
+					Lines:     Counts{Count: 3, Covered: 1, Percent: 33.3},
+					Functions: Counts{Count: 1, Covered: 0, Percent: 0},
+				},
+			},
+		}
+		report := Compute(baseline, "/src", current, "/src", 0)
+
+		if len(report.Files) != 1 {
+			t.Fatalf("Compute(...).Files = %+v, want 1 entry", report.Files)
+		}
+		got := report.Files[0]
+		want := FileDiff{
+			Filename:            "foo.cc",
+			Status:              "changed",
+			LineCoverageDelta:   33.3 - 66.6,
+			FuncCoverageDelta:   0 - 100,
+			NewlyUncoveredLines: []int{2},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Compute(...).Files[0] = %+v, want %+v", got, want)
+		}
+		if !report.Regressed {
+			t.Errorf("Compute(...).Regressed = false, want true")
+		}
+	})
+
+	t.Run("net-zero percentage delta still reports newly uncovered lines", func(t *testing.T) {
+		baseline := []FileSummary{
+			{
+				Filename: "/src/foo.cc",
+				Segments: []Segment{
+					{Line: 1, Count: 1, HasCount: true},
+					{Line: 2, Count: 0, HasCount: true},
+					{Line: 3, Count: 0, HasCount: true},
+				},
+				Summary: struct {
+					Lines     Counts `json:"lines"`
+					Functions Counts `json:"functions"`
+				}{Lines: Counts{Count: 3, Covered: 1, Percent: 33.3}},
+			},
+		}
+		current := []FileSummary{
+			{
+				Filename: "/src/foo.cc",
+				Segments: []Segment{
+					{Line: 1, Count: 0, HasCount: true},
+					{Line: 2, Count: 1, HasCount: true},
+					{Line: 3, Count: 0, HasCount: true},
+				},
+				Summary: struct {
+					Lines     Counts `json:"lines"`
+					Functions Counts `json:"functions"`
+				}{Lines: Counts{Count: 3, Covered: 1, Percent: 33.3}},
+			},
+		}
+		report := Compute(baseline, "/src", current, "/src", 0)
+
+		if len(report.Files) != 1 {
+			t.Fatalf("Compute(...).Files = %+v, want 1 entry", report.Files)
+		}
+		got := report.Files[0]
+		want := FileDiff{
+			Filename:            "foo.cc",
+			Status:              "changed",
+			NewlyUncoveredLines: []int{1},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Compute(...).Files[0] = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("regression within min-delta threshold is not flagged", func(t *testing.T) {
+		baseline := []FileSummary{
+			{Filename: "/src/foo.cc", Summary: struct {
+				Lines     Counts `json:"lines"`
+				Functions Counts `json:"functions"`
+			}{Lines: Counts{Count: 1000, Covered: 1000, Percent: 100}}},
+		}
+		current := []FileSummary{
+			{Filename: "/src/foo.cc", Summary: struct {
+				Lines     Counts `json:"lines"`
+				Functions Counts `json:"functions"`
+			}{Lines: Counts{Count: 1000, Covered: 995, Percent: 99.5}}},
+		}
+		report := Compute(baseline, "/src", current, "/src", 1.0)
+		if report.Regressed {
+			t.Errorf("Compute(...).Regressed = true, want false for a delta within minDelta")
+		}
+	})
+}
+
+func sameFileDiffSet(got, want []FileDiff) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	index := func(fds []FileDiff, fd FileDiff) int {
+		for i, other := range fds {
+			if reflect.DeepEqual(fd, other) {
+				return i
+			}
+		}
+		return -1
+	}
+	remaining := append([]FileDiff(nil), want...)
+	for _, fd := range got {
+		i := index(remaining, fd)
+		if i == -1 {
+			return false
+		}
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package export implements the exporters used by covargs to turn a merged
+// llvm-profdata profile into one or more report formats. An Output describes
+// a single requested report, modeled on the buildkit exporter API: a `type`
+// selects the Exporter implementation and the remaining comma-separated
+// `key=value` attributes configure it, with `dest` choosing the output
+// location. For the lcov, json and tar types `dest=-` means stdout; the html
+// and text types always write a directory tree to dest.
+package export
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Output is a single parsed `-output` flag value, e.g.
+// `type=lcov,dest=coverage.lcov`.
+type Output struct {
+	Type  string
+	Attrs map[string]string
+}
+
+// Dest returns the `dest` attribute, or "" if none was given.
+func (o Output) Dest() string {
+	return o.Attrs["dest"]
+}
+
+// ParseOutput parses a single `-output` flag value of the form
+// `type=X,key=value,...`. The `type` attribute is required.
+func ParseOutput(s string) (Output, error) {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(s, ",") {
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return Output{}, fmt.Errorf("malformed attribute %q in -output %q, want key=value", field, s)
+		}
+		attrs[parts[0]] = parts[1]
+	}
+	typ, ok := attrs["type"]
+	if !ok {
+		return Output{}, fmt.Errorf("-output %q is missing required \"type\" attribute", s)
+	}
+	delete(attrs, "type")
+	return Output{Type: typ, Attrs: attrs}, nil
+}
+
+// Env carries the inputs every Exporter needs to invoke llvm-cov against the
+// merged profile.
+type Env struct {
+	LlvmCov       string
+	MergedProfile string
+	Modules       []string
+	DryRun        bool
+}
+
+// objectArgsFile writes the `-object <module>` arguments shared by every
+// llvm-cov invocation to a response file and returns its path. Large builds
+// instrument hundreds of modules, so these are passed via `@file` rather
+// than directly on argv to stay under the platform's argument-list limit.
+func (e Env) objectArgsFile() (string, error) {
+	f, err := ioutil.TempFile("", "llvm-cov-objects.rsp")
+	if err != nil {
+		return "", fmt.Errorf("creating llvm-cov objects response file: %v", err)
+	}
+	defer f.Close()
+	for _, mod := range e.Modules {
+		fmt.Fprintf(f, "-object\n%s\n", mod)
+	}
+	return f.Name(), nil
+}
+
+// run invokes llvm-cov with the given subcommand, the shared `-instr-profile`
+// argument, the extra arguments, and then the shared `-object` arguments. It
+// returns llvm-cov's stdout, or its stderr if the command fails.
+func (e Env) run(ctx context.Context, subcommand string, args ...string) ([]byte, error) {
+	if e.DryRun {
+		return nil, nil
+	}
+	rsp, err := e.objectArgsFile()
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(rsp)
+	all := append([]string{subcommand, "-instr-profile", e.MergedProfile}, args...)
+	all = append(all, "@"+rsp)
+	cmd := exec.CommandContext(ctx, e.LlvmCov, all...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return stderr.Bytes(), err
+	}
+	return out, nil
+}
+
+// Exporter produces a single coverage report from a merged profile.
+type Exporter interface {
+	// Export runs llvm-cov (via env) and writes the resulting report to the
+	// destination configured on the Exporter.
+	Export(ctx context.Context, env Env) error
+}
+
+// New constructs the Exporter for the given Output, or an error if the
+// output's type is unknown or missing a required attribute.
+func New(out Output) (Exporter, error) {
+	switch out.Type {
+	case "html":
+		return newHTMLExporter(out)
+	case "text":
+		return newTextExporter(out)
+	case "lcov":
+		return newLcovExporter(out)
+	case "json":
+		return newJSONExporter(out)
+	case "tar":
+		return newTarExporter(out)
+	default:
+		return nil, fmt.Errorf("unknown -output type %q", out.Type)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package export
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Output
+		wantErr bool
+	}{
+		{
+			name:  "type only",
+			input: "type=html",
+			want:  Output{Type: "html", Attrs: map[string]string{}},
+		},
+		{
+			name:  "type and dest",
+			input: "type=lcov,dest=coverage.lcov",
+			want:  Output{Type: "lcov", Attrs: map[string]string{"dest": "coverage.lcov"}},
+		},
+		{
+			name:  "dest value containing an equals sign",
+			input: "type=json,dest=out=file.json",
+			want:  Output{Type: "json", Attrs: map[string]string{"dest": "out=file.json"}},
+		},
+		{
+			name:  "dest of a single dash for stdout",
+			input: "type=tar,dest=-",
+			want:  Output{Type: "tar", Attrs: map[string]string{"dest": "-"}},
+		},
+		{
+			name:    "missing type",
+			input:   "dest=coverage.lcov",
+			wantErr: true,
+		},
+		{
+			name:    "malformed attribute with no equals sign",
+			input:   "type=html,dest",
+			wantErr: true,
+		},
+		{
+			name:    "empty string",
+			input:   "",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseOutput(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseOutput(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseOutput(%q) = %+v, want %+v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
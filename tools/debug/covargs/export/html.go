@@ -0,0 +1,32 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package export
+
+import (
+	"context"
+	"fmt"
+)
+
+// htmlExporter runs `llvm-cov show -format html`, writing the resulting tree
+// of HTML files to dest.
+type htmlExporter struct {
+	dest string
+}
+
+func newHTMLExporter(out Output) (Exporter, error) {
+	dest := out.Dest()
+	if dest == "" {
+		return nil, fmt.Errorf("-output type=html requires a dest= attribute")
+	}
+	return &htmlExporter{dest: dest}, nil
+}
+
+func (e *htmlExporter) Export(ctx context.Context, env Env) error {
+	data, err := env.run(ctx, "show", "-format", "html", "-output-dir", e.dest)
+	if err != nil {
+		return fmt.Errorf("llvm-cov show -format html: %v:\n%s", err, string(data))
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package export
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// jsonExporter runs `llvm-cov export`, writing the resulting JSON summary to
+// dest, or to stdout when dest is "-".
+type jsonExporter struct {
+	dest string
+}
+
+func newJSONExporter(out Output) (Exporter, error) {
+	dest := out.Dest()
+	if dest == "" {
+		return nil, fmt.Errorf("-output type=json requires a dest= attribute")
+	}
+	return &jsonExporter{dest: dest}, nil
+}
+
+func (e *jsonExporter) Export(ctx context.Context, env Env) error {
+	data, err := env.run(ctx, "export")
+	if err != nil {
+		return fmt.Errorf("llvm-cov export: %v:\n%s", err, string(data))
+	}
+	if env.DryRun {
+		return nil
+	}
+	if e.dest == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(e.dest, data, 0644)
+}
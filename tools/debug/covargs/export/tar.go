@@ -0,0 +1,88 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package export
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// tarExporter renders the html exporter's tree to a scratch directory and
+// streams it into a tarball, written to dest or to stdout when dest is "-".
+type tarExporter struct {
+	dest string
+}
+
+func newTarExporter(out Output) (Exporter, error) {
+	dest := out.Dest()
+	if dest == "" {
+		return nil, fmt.Errorf("-output type=tar requires a dest= attribute")
+	}
+	return &tarExporter{dest: dest}, nil
+}
+
+func (e *tarExporter) Export(ctx context.Context, env Env) error {
+	dir, err := ioutil.TempDir("", "covargs-tar")
+	if err != nil {
+		return fmt.Errorf("creating temporary html dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	html := &htmlExporter{dest: dir}
+	if err := html.Export(ctx, env); err != nil {
+		return err
+	}
+	if env.DryRun {
+		return nil
+	}
+
+	if e.dest == "-" {
+		return writeTar(dir, os.Stdout)
+	}
+	out, err := os.Create(e.dest)
+	if err != nil {
+		return fmt.Errorf("creating %q: %v", e.dest, err)
+	}
+	defer out.Close()
+	return writeTar(dir, out)
+}
+
+func writeTar(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+}
@@ -0,0 +1,32 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package export
+
+import (
+	"context"
+	"fmt"
+)
+
+// textExporter runs `llvm-cov show -format text`, writing the resulting tree
+// of annotated source files to dest.
+type textExporter struct {
+	dest string
+}
+
+func newTextExporter(out Output) (Exporter, error) {
+	dest := out.Dest()
+	if dest == "" {
+		return nil, fmt.Errorf("-output type=text requires a dest= attribute")
+	}
+	return &textExporter{dest: dest}, nil
+}
+
+func (e *textExporter) Export(ctx context.Context, env Env) error {
+	data, err := env.run(ctx, "show", "-format", "text", "-output-dir", e.dest)
+	if err != nil {
+		return fmt.Errorf("llvm-cov show -format text: %v:\n%s", err, string(data))
+	}
+	return nil
+}